@@ -1,28 +1,137 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 const (
-	defaultDuration = 5
+	defaultDuration    = 5
+	defaultPartSizeMB  = 5
+	defaultConcurrency = 5
+	defaultWorkers     = 4
+	maxUploadAttempts  = 5
+	sha256MetadataKey  = "sha256"
 )
 
-func getPresignedURL(svc *s3.S3, bucket, key string, duration int64) (string, error) {
-	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+// progressReader wraps an io.Reader and reports bytes read / ETA to stderr
+// as the underlying reader is consumed by the uploader.
+type progressReader struct {
+	io.Reader
+	total int64
+	read  int64
+	start time.Time
+}
+
+func newProgressReader(r io.Reader, total int64) *progressReader {
+	return &progressReader{Reader: r, total: total, start: time.Now()}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.Reader.Read(p)
+	pr.read += int64(n)
+
+	elapsed := time.Since(pr.start)
+	if pr.total > 0 {
+		pct := float64(pr.read) / float64(pr.total) * 100
+		var eta time.Duration
+		if pr.read > 0 {
+			eta = time.Duration(float64(elapsed) * (float64(pr.total)/float64(pr.read) - 1))
+		}
+		fmt.Fprintf(os.Stderr, "\r%d/%d bytes (%.1f%%) ETA %s   ", pr.read, pr.total, pct, eta.Round(time.Second))
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%d bytes", pr.read)
+	}
+
+	if err == io.EOF {
+		fmt.Fprintln(os.Stderr)
+	}
+
+	return n, err
+}
+
+// presignOptions carries the headers that become part of the signature
+// for presigned upload (PUT) URLs.
+type presignOptions struct {
+	ContentType string
+	ContentMD5  string
+	SSE         string
+	SSEKMSKeyID string
+	Metadata    map[string]string
+}
+
+// getPresignedURL returns a presigned URL for the given S3 method
+// (GET, PUT, HEAD, or DELETE) against bucket/key, valid for duration
+// minutes. opts is only applied to PUT requests.
+func getPresignedURL(svc *s3.S3, method, bucket, key string, duration int64, opts presignOptions) (string, error) {
+	var req *request.Request
+
+	switch strings.ToUpper(method) {
+	case "", "GET":
+		req, _ = svc.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	case "PUT":
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		if opts.ContentType != "" {
+			input.ContentType = aws.String(opts.ContentType)
+		}
+		if opts.ContentMD5 != "" {
+			input.ContentMD5 = aws.String(opts.ContentMD5)
+		}
+		if opts.SSE != "" {
+			input.ServerSideEncryption = aws.String(opts.SSE)
+		}
+		if opts.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(opts.SSEKMSKeyID)
+		}
+		if len(opts.Metadata) > 0 {
+			input.Metadata = make(map[string]*string, len(opts.Metadata))
+			for k, v := range opts.Metadata {
+				input.Metadata[k] = aws.String(v)
+			}
+		}
+		req, _ = svc.PutObjectRequest(input)
+	case "HEAD":
+		req, _ = svc.HeadObjectRequest(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	case "DELETE":
+		req, _ = svc.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	default:
+		return "", fmt.Errorf("unsupported -method %q (want GET, PUT, HEAD, or DELETE)", method)
+	}
 
 	signedURL, err := req.Presign(time.Duration(duration) * time.Minute)
 	if err != nil {
@@ -32,7 +141,19 @@ func getPresignedURL(svc *s3.S3, bucket, key string, duration int64) (string, er
 	return signedURL, nil
 }
 
-func parseURL(s3URL string) (string, string, error) {
+// isAWSVirtualHostedStyle reports whether host looks like an AWS
+// virtual-hosted-style S3 host, e.g. bucket.s3.region.amazonaws.com or
+// bucket.s3.amazonaws.com.
+func isAWSVirtualHostedStyle(host string) bool {
+	return strings.HasSuffix(host, "amazonaws.com") && strings.Contains(host, ".s3")
+}
+
+// parseURL extracts the bucket and key from an s3:// URI, a path-style
+// HTTPS URL, or a virtual-hosted-style HTTPS URL. endpoint is the
+// configured custom S3 endpoint (may be empty), used to recognize
+// virtual-hosted-style URLs against S3-compatible services whose bucket
+// is a subdomain rather than the first path segment.
+func parseURL(s3URL, endpoint string) (string, string, error) {
 	var bucket, key string
 
 	u, err := url.Parse(s3URL)
@@ -43,8 +164,31 @@ func parseURL(s3URL string) (string, string, error) {
 	if u.Scheme == "s3" { // s3://bucket/key
 		bucket = u.Host
 		key = strings.Replace(u.Path, "/", "", 1)
-	} else { // https://s3-ap-northeast-1.amazonaws.com/bucket/key
+		return bucket, key, nil
+	}
+
+	endpointHost := endpoint
+	if endpointHost != "" {
+		if eu, err := url.Parse(endpointHost); err == nil && eu.Host != "" {
+			endpointHost = eu.Host
+		}
+	}
+
+	switch {
+	case isAWSVirtualHostedStyle(u.Host):
+		// https://bucket.s3.region.amazonaws.com/key or https://bucket.s3.amazonaws.com/key
+		bucket = strings.SplitN(u.Host, ".s3", 2)[0]
+		key = strings.TrimPrefix(u.Path, "/")
+	case endpointHost != "" && u.Host != endpointHost && strings.HasSuffix(u.Host, "."+endpointHost):
+		// virtual-hosted style against a custom endpoint: https://bucket.endpoint/key
+		bucket = strings.TrimSuffix(u.Host, "."+endpointHost)
+		key = strings.TrimPrefix(u.Path, "/")
+	default:
+		// path-style: https://s3-region.amazonaws.com/bucket/key or https://endpoint/bucket/key
 		ss := strings.SplitN(u.Path, "/", 3)
+		if len(ss) < 3 {
+			return "", "", fmt.Errorf("Invalid URL: %s.\n", s3URL)
+		}
 		bucket = ss[1]
 		key = ss[2]
 	}
@@ -52,32 +196,413 @@ func parseURL(s3URL string) (string, string, error) {
 	return bucket, key, nil
 }
 
-func uploadToS3(svc *s3.S3, path, bucket, key string) error {
-	fp, err := os.Open(path)
+// uploadToS3 streams r to bucket/key using the given uploader. size is the
+// total number of bytes in r, or -1 if unknown (e.g. stdin); when progress
+// is true, bytes transferred and an ETA are printed to stderr as the
+// upload proceeds. ctx bounds the upload so it can be cancelled or timed
+// out cleanly.
+func uploadToS3(ctx context.Context, uploader *s3manager.Uploader, r io.Reader, size int64, bucket, key string, progress bool) error {
+	if progress {
+		r = newProgressReader(r, size)
+	}
+
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	})
 	if err != nil {
 		return err
 	}
+
+	return nil
+}
+
+// isThrottlingError reports whether err, or an error it wraps (such as the
+// part error inside a multipart upload failure), is an S3/SDK error code
+// that indicates the request should be retried after backing off.
+func isThrottlingError(err error) bool {
+	for err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+
+		switch aerr.Code() {
+		case "SlowDown", "RequestLimitExceeded", "ThrottlingException", "Throttling", "TooManyRequestsException":
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+
+	return false
+}
+
+// uploadFileWithRetry uploads path to bucket/key, retrying with exponential
+// backoff (plus jitter) when S3 reports throttling, up to maxUploadAttempts.
+func uploadFileWithRetry(ctx context.Context, uploader *s3manager.Uploader, path, bucket, key string, metadata map[string]*string) error {
+	var err error
+
+	for attempt := 0; attempt < maxUploadAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+			backoff += time.Duration(rand.Int63n(int64(time.Second)))
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var fp *os.File
+		fp, err = os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			Body:     fp,
+			Metadata: metadata,
+		})
+		fp.Close()
+
+		if err == nil || !isThrottlingError(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// hashFile returns the hex-encoded sha256 digest of the file at path.
+func hashFile(path string) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
 	defer fp.Close()
 
-	_, err = svc.PutObject(&s3.PutObjectInput{
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// unchangedInS3 reports whether bucket/key already holds an object whose
+// stored sha256 metadata matches hash.
+func unchangedInS3(svc *s3.S3, bucket, key, hash string) bool {
+	out, err := svc.HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-		Body:   fp,
 	})
 	if err != nil {
-		return err
+		return false
+	}
+
+	existing, ok := out.Metadata[sha256MetadataKey]
+	return ok && existing != nil && *existing == hash
+}
+
+// uploadSummary tallies the outcome of a directory upload.
+type uploadSummary struct {
+	succeeded int
+	skipped   int
+	failed    int
+}
+
+// uploadJob is one file queued for upload by uploadDirectory.
+type uploadJob struct {
+	path string
+	key  string
+}
+
+// uploadDirectory walks root and uploads every entry that is not a directory to
+// bucket, keyed by keyPrefix joined with the file's path relative to root.
+// A fixed pool of workers goroutines drains the file list, so concurrency
+// never exceeds workers regardless of how many files root contains; when
+// skipExisting is set, a file is skipped if bucket already holds an object
+// with a matching sha256 content hash.
+func uploadDirectory(ctx context.Context, svc *s3.S3, uploader *s3manager.Uploader, root, bucket, keyPrefix string, workers int, skipExisting bool) (uploadSummary, error) {
+	jobs := make(chan uploadJob)
+
+	walkErrCh := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+
+		walkErrCh <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			key := strings.TrimPrefix(keyPrefix+"/"+filepath.ToSlash(rel), "/")
+
+			select {
+			case jobs <- uploadJob{path: path, key: key}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+	}()
+
+	var (
+		summary uploadSummary
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for job := range jobs {
+				var metadata map[string]*string
+				if skipExisting {
+					hash, err := hashFile(job.path)
+					if err == nil {
+						if unchangedInS3(svc, bucket, job.key, hash) {
+							fmt.Fprintln(os.Stderr, "skipped (unchanged): "+job.path)
+							mu.Lock()
+							summary.skipped++
+							mu.Unlock()
+							continue
+						}
+						metadata = map[string]*string{sha256MetadataKey: aws.String(hash)}
+					}
+				}
+
+				if err := uploadFileWithRetry(ctx, uploader, job.path, bucket, job.key, metadata); err != nil {
+					fmt.Fprintf(os.Stderr, "failed: %s: %s\n", job.path, err)
+					mu.Lock()
+					summary.failed++
+					mu.Unlock()
+					continue
+				}
+
+				fmt.Fprintln(os.Stderr, "uploaded: "+job.path)
+				mu.Lock()
+				summary.succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := <-walkErrCh; err != nil && err != ctx.Err() {
+		return summary, err
+	}
+
+	return summary, nil
+}
+
+// condition is a single user-supplied -condition key=value pair for a
+// presigned POST policy.
+type condition struct {
+	key   string
+	value string
+}
+
+// conditionsFlag collects repeated -condition key=value flags.
+type conditionsFlag []condition
+
+func (c *conditionsFlag) String() string {
+	return fmt.Sprint([]condition(*c))
+}
+
+func (c *conditionsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid -condition %q, want key=value", s)
+	}
+
+	*c = append(*c, condition{key: parts[0], value: parts[1]})
+	return nil
+}
+
+// metadataFlag collects repeated -metadata key=value flags into a map.
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	return fmt.Sprint(map[string]string(m))
+}
+
+func (m *metadataFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid -metadata %q, want key=value", s)
 	}
 
+	if *m == nil {
+		*m = metadataFlag{}
+	}
+	(*m)[parts[0]] = parts[1]
 	return nil
 }
 
+// postPolicy is the JSON document handed to a browser so it can POST an
+// object directly to S3.
+type postPolicy struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// postObjectURL builds the form action URL for bucket under the active
+// endpoint/region/path-style configuration.
+func postObjectURL(endpoint, region, bucket string, pathStyle, disableSSL bool) string {
+	scheme := "https"
+	if disableSSL {
+		scheme = "http"
+	}
+
+	if endpoint != "" {
+		host := endpoint
+		if eu, err := url.Parse(endpoint); err == nil && eu.Host != "" {
+			host = eu.Host
+		}
+		if pathStyle {
+			return fmt.Sprintf("%s://%s/%s/", scheme, host, bucket)
+		}
+		return fmt.Sprintf("%s://%s.%s/", scheme, bucket, host)
+	}
+
+	if region != "" && region != "us-east-1" {
+		return fmt.Sprintf("%s://%s.s3.%s.amazonaws.com/", scheme, bucket, region)
+	}
+	return fmt.Sprintf("%s://%s.s3.amazonaws.com/", scheme, bucket)
+}
+
+// generatePostPolicy builds a SigV4-signed POST policy allowing a browser
+// to upload key into bucket directly, valid for expires, subject to the
+// given extra conditions.
+func generatePostPolicy(sess *session.Session, endpoint, region, bucket, key string, pathStyle, disableSSL bool, expires time.Duration, conditions []condition) (postPolicy, error) {
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return postPolicy{}, err
+	}
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+	credential := fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKeyID, dateStamp, region)
+
+	policyConditions := []interface{}{
+		map[string]string{"bucket": bucket},
+		map[string]string{"key": key},
+		map[string]string{"x-amz-algorithm": "AWS4-HMAC-SHA256"},
+		map[string]string{"x-amz-credential": credential},
+		map[string]string{"x-amz-date": amzDate},
+	}
+
+	fields := map[string]string{
+		"key":              key,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": credential,
+		"x-amz-date":       amzDate,
+	}
+
+	if creds.SessionToken != "" {
+		policyConditions = append(policyConditions, map[string]string{"x-amz-security-token": creds.SessionToken})
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+
+	for _, c := range conditions {
+		switch {
+		case c.key == "content-length-range":
+			parts := strings.SplitN(c.value, ",", 2)
+			if len(parts) != 2 {
+				return postPolicy{}, fmt.Errorf("invalid content-length-range %q, want min,max", c.value)
+			}
+			min, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+			if err != nil {
+				return postPolicy{}, fmt.Errorf("invalid content-length-range %q: %s", c.value, err)
+			}
+			max, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+			if err != nil {
+				return postPolicy{}, fmt.Errorf("invalid content-length-range %q: %s", c.value, err)
+			}
+			policyConditions = append(policyConditions, []interface{}{"content-length-range", min, max})
+		case strings.EqualFold(c.key, "Content-Type"):
+			policyConditions = append(policyConditions, []interface{}{"starts-with", "$Content-Type", c.value})
+		default:
+			policyConditions = append(policyConditions, map[string]string{c.key: c.value})
+			fields[c.key] = c.value
+		}
+	}
+
+	policyDoc := map[string]interface{}{
+		"expiration": now.Add(expires).Format(time.RFC3339),
+		"conditions": policyConditions,
+	}
+
+	policyJSON, err := json.Marshal(policyDoc)
+	if err != nil {
+		return postPolicy{}, err
+	}
+	encodedPolicy := base64.StdEncoding.EncodeToString(policyJSON)
+
+	kDate := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), dateStamp)
+	kRegion := hmacSHA256(kDate, region)
+	kService := hmacSHA256(kRegion, "s3")
+	kSigning := hmacSHA256(kService, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(kSigning, encodedPolicy))
+
+	fields["policy"] = encodedPolicy
+	fields["x-amz-signature"] = signature
+
+	return postPolicy{
+		URL:    postObjectURL(endpoint, region, bucket, pathStyle, disableSSL),
+		Fields: fields,
+	}, nil
+}
+
 func main() {
 	var (
-		bucket   string
-		duration int64
-		key      string
-		profile  string
-		upload   string
+		bucket       string
+		concurrency  int
+		conditions   conditionsFlag
+		contentMD5   string
+		contentType  string
+		disableSSL   bool
+		duration     int64
+		endpoint     string
+		key          string
+		metadata     metadataFlag
+		method       string
+		partSizeMB   int64
+		pathStyle    bool
+		post         bool
+		profile      string
+		progress     bool
+		region       string
+		sse          string
+		sseKMSKeyID  string
+		skipExisting bool
+		timeout      int64
+		upload       string
+		workers      int
 	)
 
 	f := flag.NewFlagSet("s3url", flag.ExitOnError)
@@ -95,12 +620,30 @@ Options:
 
 	f.StringVar(&bucket, "bucket", "", "Bucket name")
 	f.StringVar(&bucket, "b", "", "Bucket name")
+	f.IntVar(&concurrency, "concurrency", defaultConcurrency, "Number of parts to upload concurrently per file")
+	f.Var(&conditions, "condition", "Extra POST policy condition as key=value (repeatable); used with -post")
+	f.StringVar(&contentMD5, "content-md5", "", "Content-MD5 to sign into a -method PUT presigned URL")
+	f.StringVar(&contentType, "content-type", "", "Content-Type to sign into a -method PUT presigned URL")
+	f.BoolVar(&disableSSL, "disable-ssl", false, "Use plain HTTP instead of HTTPS to talk to the endpoint")
 	f.Int64Var(&duration, "duration", defaultDuration, "Valid duration in minutes")
 	f.Int64Var(&duration, "d", defaultDuration, "Valid duration in minutes")
-	f.StringVar(&key, "key", "", "Object key")
-	f.StringVar(&key, "k", "", "Object key")
+	f.StringVar(&endpoint, "endpoint", os.Getenv("S3_ENDPOINT"), "Custom S3-compatible endpoint (e.g. for MinIO, Ceph, DigitalOcean Spaces)")
+	f.StringVar(&key, "key", "", "Object key, or key prefix when -upload is a directory")
+	f.StringVar(&key, "k", "", "Object key, or key prefix when -upload is a directory")
+	f.Var(&metadata, "metadata", "x-amz-meta-* header to sign into a -method PUT presigned URL, as key=value (repeatable)")
+	f.StringVar(&method, "method", "GET", "S3 operation to presign: GET, PUT, HEAD, or DELETE")
+	f.Int64Var(&partSizeMB, "part-size", defaultPartSizeMB, "Multipart upload part size in MB")
+	f.BoolVar(&pathStyle, "path-style", os.Getenv("S3_PATH_STYLE") != "", "Force path-style bucket addressing instead of virtual-hosted-style")
+	f.BoolVar(&post, "post", false, "Print a presigned POST policy (for browser form uploads) instead of a presigned URL")
 	f.StringVar(&profile, "profile", "", "AWS profile name")
-	f.StringVar(&upload, "upload", "", "File to upload")
+	f.BoolVar(&progress, "progress", false, "Print upload progress and ETA to stderr")
+	f.StringVar(&region, "region", os.Getenv("S3_REGION"), "AWS region, or the region understood by the custom endpoint")
+	f.StringVar(&sse, "sse", "", "Server-side encryption to sign into a -method PUT presigned URL: AES256 or aws:kms")
+	f.StringVar(&sseKMSKeyID, "sse-kms-key-id", "", "KMS key ID to sign in when -sse is aws:kms")
+	f.BoolVar(&skipExisting, "skip-existing", false, "Skip files whose content hash already matches the S3 object (only when -upload is a directory)")
+	f.Int64Var(&timeout, "timeout", 0, "Abort the upload after this many seconds (0 means no timeout)")
+	f.StringVar(&upload, "upload", "", "File or directory to upload, or - to read a single file from stdin")
+	f.IntVar(&workers, "workers", defaultWorkers, "Number of files to upload concurrently when -upload is a directory")
 
 	f.Parse(os.Args[1:])
 
@@ -127,7 +670,7 @@ Options:
 	}
 
 	if s3URL != "" {
-		bucket, key, err = parseURL(s3URL)
+		bucket, key, err = parseURL(s3URL, endpoint)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
@@ -144,24 +687,132 @@ Options:
 		os.Exit(1)
 	}
 
-	svc := s3.New(sess, &aws.Config{})
+	if strings.ToUpper(method) != "PUT" && (contentType != "" || contentMD5 != "" || sse != "" || sseKMSKeyID != "" || len(metadata) > 0) {
+		fmt.Fprintln(os.Stderr, "-content-type, -content-md5, -sse, -sse-kms-key-id, and -metadata only apply to -method PUT")
+		os.Exit(1)
+	}
+
+	if sseKMSKeyID != "" && sse != "aws:kms" {
+		fmt.Fprintln(os.Stderr, "-sse-kms-key-id requires -sse aws:kms")
+		os.Exit(1)
+	}
+
+	// LowerCaseHeaderMaps keeps user-metadata keys lowercase on read (the SDK
+	// otherwise canonicalizes them, e.g. "sha256" -> "Sha256"), so -skip-existing
+	// can compare against the key it wrote without guessing the canonical form.
+	cfg := aws.NewConfig().WithLowerCaseHeaderMaps(true)
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	if pathStyle {
+		cfg = cfg.WithS3ForcePathStyle(true)
+	}
+	if disableSSL {
+		cfg = cfg.WithDisableSSL(true)
+	}
+
+	svc := s3.New(sess, cfg)
 
 	if upload != "" {
-		path, err := filepath.Abs(upload)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if timeout > 0 {
+			var timeoutCancel context.CancelFunc
+			ctx, timeoutCancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+			defer timeoutCancel()
+		}
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt)
+		go func() {
+			<-sigCh
+			fmt.Fprintln(os.Stderr, "\ninterrupted, cancelling upload...")
+			cancel()
+		}()
+
+		uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+			u.PartSize = partSizeMB * 1024 * 1024
+			u.Concurrency = concurrency
+		})
+
+		if upload == "-" {
+			if err := uploadToS3(ctx, uploader, os.Stdin, -1, bucket, key, progress); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Fprintln(os.Stderr, "uploaded: stdin")
+		} else {
+			path, err := filepath.Abs(upload)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			if info.IsDir() {
+				summary, err := uploadDirectory(ctx, svc, uploader, path, bucket, key, workers, skipExisting)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+
+				fmt.Fprintf(os.Stderr, "done: %d succeeded, %d skipped, %d failed\n", summary.succeeded, summary.skipped, summary.failed)
+				if summary.failed > 0 {
+					os.Exit(1)
+				}
+			} else {
+				fp, err := os.Open(path)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+
+				if err := uploadToS3(ctx, uploader, fp, info.Size(), bucket, key, progress); err != nil {
+					fp.Close()
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				fp.Close()
+
+				fmt.Fprintln(os.Stderr, "uploaded: "+path)
+			}
+		}
+	}
+
+	if post {
+		policy, err := generatePostPolicy(sess, endpoint, region, bucket, key, pathStyle, disableSSL, time.Duration(duration)*time.Minute, conditions)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 
-		if err := uploadToS3(svc, path, bucket, key); err != nil {
+		out, err := json.MarshalIndent(policy, "", "  ")
+		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 
-		fmt.Fprintln(os.Stderr, "uploaded: "+path)
+		fmt.Println(string(out))
+		return
 	}
 
-	signedURL, err := getPresignedURL(svc, bucket, key, duration)
+	signedURL, err := getPresignedURL(svc, method, bucket, key, duration, presignOptions{
+		ContentType: contentType,
+		ContentMD5:  contentMD5,
+		SSE:         sse,
+		SSEKMSKeyID: sseKMSKeyID,
+		Metadata:    metadata,
+	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)